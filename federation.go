@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// instanceBaseURL is this node's own externally-reachable origin, used to
+// mint its actor IRI and as the "keyId" on outbound signed requests. It is
+// set once from main().
+var instanceBaseURL = "http://localhost:8080"
+
+// instanceKey is this node's federation keypair, used to sign outbound
+// deliveries and to answer the actor endpoint's public key.
+var instanceKey *rsa.PrivateKey
+
+// Actor is the JSON-LD actor document this node publishes so remote nodes
+// can discover our inbox and public key, per the ActivityPub spec
+// (https://www.w3.org/TR/activitypub/#actor-objects).
+type Actor struct {
+	Context   interface{}   `json:"@context"`
+	ID        string        `json:"id"`
+	Type      string        `json:"type"`
+	Inbox     string        `json:"inbox"`
+	PublicKey ActorKeyOwner `json:"publicKey"`
+}
+
+type ActorKeyOwner struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// actorIRI is this node's own actor IRI.
+func actorIRI() string {
+	return fmt.Sprintf("%s/actor", instanceBaseURL)
+}
+
+// loadOrGenerateKeypair reads a PEM-encoded RSA private key from path, or
+// generates and persists a fresh 2048-bit keypair if none exists yet.
+// Federation identity has to be stable across restarts, so the key lives
+// on disk rather than being minted per-process.
+func loadOrGenerateKeypair(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("federation: invalid PEM in " + path)
+		}
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func publicKeyPem(key *rsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	block := &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// handleActor serves this node's actor document, exposing the public key
+// remote senders need to verify our signed deliveries and the inbox they
+// should use for replies.
+func handleActor(w http.ResponseWriter, r *http.Request) {
+	pem, err := publicKeyPem(instanceKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	actor := Actor{
+		Context: []string{
+			"https://www.w3.org/ns/activitystreams",
+			"https://w3id.org/security/v1",
+		},
+		ID:    actorIRI(),
+		Type:  "Service",
+		Inbox: fmt.Sprintf("%s/inbox", instanceBaseURL),
+		PublicKey: ActorKeyOwner{
+			ID:           actorIRI() + "#main-key",
+			Owner:        actorIRI(),
+			PublicKeyPem: pem,
+		},
+	}
+
+	w.Header().Set("content-type", "application/ld+json")
+	writeJSON(w, actor)
+}
+
+// parseSignatureHeader parses the Cavage-draft Signature header into its
+// named parameters, e.g. `keyId="...",algorithm="rsa-sha256",
+// headers="(request-target) host date",signature="..."`.
+func parseSignatureHeader(header string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("federation: malformed Signature parameter %q", part)
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, errors.New("federation: Signature header missing keyId or signature")
+	}
+	return params, nil
+}
+
+// buildSigningString reconstructs the Cavage signing string for r, covering
+// exactly the headers the sender listed (defaulting to just "date" if they
+// didn't specify any).
+func buildSigningString(r *http.Request, headers []string) string {
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		if h == "(request-target)" {
+			lines[i] = fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI())
+			continue
+		}
+		if strings.EqualFold(h, "host") {
+			host := r.Host
+			if host == "" {
+				host = r.Header.Get("Host")
+			}
+			lines[i] = fmt.Sprintf("%s: %s", h, host)
+			continue
+		}
+		lines[i] = fmt.Sprintf("%s: %s", h, r.Header.Get(h))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// fetchActorPublicKey dereferences an actor IRI and extracts its RSA
+// public key, so an inbound Signature's keyId can be resolved without the
+// sender having pre-registered with this node.
+func fetchActorPublicKey(actorURL string) (*rsa.PublicKey, error) {
+	req, err := http.NewRequest(http.MethodGet, actorURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/ld+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("federation: fetching actor %s returned %d", actorURL, resp.StatusCode)
+	}
+
+	var actor Actor
+	if err := json.NewDecoder(resp.Body).Decode(&actor); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("federation: actor %s has no usable publicKeyPem", actorURL)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("federation: actor %s publicKeyPem is not RSA", actorURL)
+	}
+	return rsaPub, nil
+}
+
+// requiredSignedHeaders are the Cavage-draft headers an inbound Signature
+// must cover. Without "(request-target)" a signature says nothing about
+// which resource or method it was issued for; without "digest" it says
+// nothing about the body, so either omission lets a captured signature be
+// replayed against a different request or with a different payload.
+var requiredSignedHeaders = []string{"(request-target)", "digest"}
+
+// maxSignatureAge bounds how stale a signed request's Date header may be
+// before it's rejected, so a captured Signature+Date pair can't be
+// replayed indefinitely.
+const maxSignatureAge = 5 * time.Minute
+
+// computeDigest returns the RFC 3230 "Digest" header value for body.
+func computeDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyInboundSignature checks r's Signature header against the public
+// key its keyId resolves to and against body, returning the actor IRI that
+// signed it. This is what stops createNotification from accepting
+// anonymous or tampered POSTs.
+func verifyInboundSignature(r *http.Request, body []byte) (string, error) {
+	sigHeader := r.Header.Get("Signature")
+	if sigHeader == "" {
+		return "", errors.New("federation: missing Signature header")
+	}
+
+	params, err := parseSignatureHeader(sigHeader)
+	if err != nil {
+		return "", err
+	}
+
+	signedHeaders := strings.Fields(params["headers"])
+	for _, required := range requiredSignedHeaders {
+		if !containsHeader(signedHeaders, required) {
+			return "", fmt.Errorf("federation: Signature must cover %q", required)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return "", fmt.Errorf("federation: missing or unparseable Date header: %w", err)
+	}
+	if age := time.Since(date); age > maxSignatureAge || age < -maxSignatureAge {
+		return "", fmt.Errorf("federation: Date header %s is outside the %s freshness window", date, maxSignatureAge)
+	}
+
+	if computeDigest(body) != r.Header.Get("Digest") {
+		return "", errors.New("federation: Digest header does not match request body")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", fmt.Errorf("federation: malformed signature: %w", err)
+	}
+
+	actorURL := strings.SplitN(params["keyId"], "#", 2)[0]
+	pub, err := fetchActorPublicKey(actorURL)
+	if err != nil {
+		return "", err
+	}
+
+	signingString := buildSigningString(r, signedHeaders)
+	hashed := sha256.Sum256([]byte(signingString))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature); err != nil {
+		return "", fmt.Errorf("federation: signature verification failed: %w", err)
+	}
+
+	return actorURL, nil
+}
+
+func containsHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// signRequest signs req per the Cavage HTTP signature draft using this
+// node's own key, covering (request-target), host, date, and digest. The
+// caller must set the Digest header (see computeDigest) before calling
+// this, since it's the request body's authentication, not something
+// signRequest can derive on its own.
+func signRequest(req *http.Request, key *rsa.PrivateKey) error {
+	if req.Header.Get("Digest") == "" {
+		return errors.New("federation: signRequest requires a Digest header to be set first")
+	}
+	if req.Header.Get("Date") == "" {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	req.Host = req.URL.Host
+	req.Header.Set("Host", req.URL.Host)
+
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	signingString := buildSigningString(req, headers)
+
+	hashed := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s#main-key",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		actorIRI(), strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature),
+	))
+	return nil
+}
+
+// discoverInbox dereferences a target resource and reads its LDN inbox
+// discovery Link header (the one setInboxLinkHeader sets for our own
+// resources, or whatever the remote node sets for theirs).
+func discoverInbox(targetIRI string) (string, error) {
+	resp, err := http.Head(targetIRI)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	for _, link := range resp.Header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			if !strings.Contains(part, `rel="http://www.w3.org/ns/ldp#inbox"`) {
+				continue
+			}
+			start := strings.Index(part, "<")
+			end := strings.Index(part, ">")
+			if start >= 0 && end > start {
+				return part[start+1 : end], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("federation: %s did not advertise an ldp#inbox Link", targetIRI)
+}
+
+// RequestOptions controls how a single notification's outbound delivery
+// is retried, mirroring the Idempotency-Key/options pattern used by
+// notification-delivery SDKs: callers can ask for fewer attempts, or
+// narrow which failures are even worth retrying.
+type RequestOptions struct {
+	MaxAttempts int
+	RetryOn     []int
+}
+
+const defaultMaxDeliveryAttempts = 5
+
+func defaultRequestOptions() RequestOptions {
+	return RequestOptions{
+		MaxAttempts: defaultMaxDeliveryAttempts,
+		RetryOn:     []int{http.StatusRequestTimeout, http.StatusTooManyRequests, 500, 502, 503, 504},
+	}
+}
+
+func (o RequestOptions) retryableStatus(status int) bool {
+	for _, code := range o.RetryOn {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+type deliveryJob struct {
+	Doc     map[string]interface{}
+	Target  string
+	Options RequestOptions
+	Attempt int
+}
+
+var deliveryQueue = make(chan deliveryJob, 256)
+
+// startDeliveryWorker runs the outbound delivery loop that turns locally
+// created notifications into signed, retried POSTs to the recipient's
+// inbox, so this node federates rather than only storing what's sent to
+// it directly.
+func startDeliveryWorker() {
+	go func() {
+		for job := range deliveryQueue {
+			if err := deliver(job.Doc, job.Target); err != nil {
+				retryDelivery(job, err)
+			}
+		}
+	}()
+}
+
+func retryDelivery(job deliveryJob, deliverErr error) {
+	if status, ok := deliverErr.(*deliveryError); ok && !job.Options.retryableStatus(status.StatusCode) {
+		log.Printf("federation: delivery to %s returned non-retryable status %d, giving up: %v", job.Target, status.StatusCode, deliverErr)
+		return
+	}
+
+	job.Attempt++
+	if job.Attempt >= job.Options.MaxAttempts {
+		log.Printf("federation: giving up delivering to %s after %d attempts: %v", job.Target, job.Attempt, deliverErr)
+		return
+	}
+	backoff := time.Duration(1<<job.Attempt) * time.Second
+	time.AfterFunc(backoff, func() {
+		deliveryQueue <- job
+	})
+}
+
+// enqueueDelivery schedules doc for delivery to target's discovered inbox
+// under opts. It is non-blocking: a full queue drops the delivery rather
+// than stalling the inbound request that triggered it.
+func enqueueDelivery(doc map[string]interface{}, target string, opts RequestOptions) {
+	select {
+	case deliveryQueue <- deliveryJob{Doc: doc, Target: target, Options: opts}:
+	default:
+		log.Printf("federation: delivery queue full, dropping delivery to %s", target)
+	}
+}
+
+// deliveryError carries the HTTP status a delivery attempt failed with, so
+// retryDelivery can tell a transient failure from one the sender's
+// RetryOn options say isn't worth retrying.
+type deliveryError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *deliveryError) Error() string {
+	return fmt.Sprintf("federation: delivery to %s returned %d", e.URL, e.StatusCode)
+}
+
+func deliver(doc map[string]interface{}, targetIRI string) error {
+	inboxURL, err := discoverInbox(targetIRI)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, inboxURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/ld+json")
+	req.Header.Set("Digest", computeDigest(body))
+
+	if err := signRequest(req, instanceKey); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return &deliveryError{StatusCode: resp.StatusCode, URL: inboxURL}
+	}
+	return nil
+}
+
+// isRemoteTarget reports whether targetIRI points somewhere other than
+// this node's own host, i.e. whether a locally created notification needs
+// outbound delivery at all.
+func isRemoteTarget(targetIRI, host string) bool {
+	u, err := url.Parse(targetIRI)
+	if err != nil {
+		return false
+	}
+	return u.Host != "" && u.Host != host
+}
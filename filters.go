@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Filter matches a single value reachable from a notification's JSON-LD
+// body by a dot-separated path (e.g. "target" or "actor.type") against one
+// comparison. This is deliberately a small subset of JSONPath/jq, covering
+// the equality and substring checks operators actually need to route
+// citation events.
+type Filter struct {
+	Path     string `json:"path"`
+	Equals   string `json:"equals,omitempty"`
+	Contains string `json:"contains,omitempty"`
+}
+
+// Rule dispatches to Actors when every Filter in Filters matches.
+type Rule struct {
+	Name    string   `json:"name"`
+	Filters []Filter `json:"filters"`
+	Actors  []string `json:"actors"`
+}
+
+// ActorConfig configures one named pipeline actor. Type selects which
+// handler runs; the remaining fields are interpreted according to Type.
+type ActorConfig struct {
+	Type       string `json:"type"` // webhook, log, discard, email, exec
+	URL        string `json:"url,omitempty"`
+	To         string `json:"to,omitempty"`
+	Executable string `json:"executable,omitempty"`
+}
+
+// PipelineConfig is the operator-defined routing table loaded from
+// config.json: named actors, and the rules that dispatch matching
+// notifications to them.
+type PipelineConfig struct {
+	Actors map[string]ActorConfig `json:"actors"`
+	Rules  []Rule                 `json:"rules"`
+}
+
+// pipelineConfig is nil when no config.json was found, in which case
+// runPipeline is a no-op; operators who don't need routing shouldn't have
+// to ship an empty file.
+var pipelineConfig *PipelineConfig
+
+// loadPipelineConfig reads the filter/actor routing table from path. A
+// missing file is not an error: the pipeline simply stays disabled.
+func loadPipelineConfig(path string) (*PipelineConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var cfg PipelineConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// extractPath walks doc along a dot-separated path and stringifies
+// whatever it finds there.
+func extractPath(doc map[string]interface{}, path string) string {
+	var current interface{} = doc
+	for _, segment := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current, ok = m[segment]
+		if !ok {
+			return ""
+		}
+	}
+	if current == nil {
+		return ""
+	}
+	if s, ok := current.(string); ok {
+		return s
+	}
+	return fmt.Sprint(current)
+}
+
+func matchFilter(doc map[string]interface{}, f Filter) bool {
+	value := extractPath(doc, f.Path)
+	switch {
+	case f.Equals != "":
+		return value == f.Equals
+	case f.Contains != "":
+		return strings.Contains(value, f.Contains)
+	default:
+		return value != ""
+	}
+}
+
+func matchRule(doc map[string]interface{}, rule Rule) bool {
+	for _, f := range rule.Filters {
+		if !matchFilter(doc, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// runPipeline routes doc through the configured rules, dispatching to
+// every actor a matching rule names. It runs after createNotification has
+// already persisted the notification, so a slow or failing actor never
+// blocks or risks the inbox POST itself.
+func runPipeline(doc map[string]interface{}) {
+	if pipelineConfig == nil {
+		return
+	}
+
+	for _, rule := range pipelineConfig.Rules {
+		if !matchRule(doc, rule) {
+			continue
+		}
+		for _, actorName := range rule.Actors {
+			cfg, ok := pipelineConfig.Actors[actorName]
+			if !ok {
+				log.Printf("pipeline: rule %q references unknown actor %q", rule.Name, actorName)
+				continue
+			}
+			dispatchActor(actorName, cfg, doc)
+		}
+	}
+}
+
+func dispatchActor(name string, cfg ActorConfig, doc map[string]interface{}) {
+	switch cfg.Type {
+	case "webhook":
+		webhookActor(name, cfg, doc)
+	case "log":
+		logActor(name, doc)
+	case "discard":
+		// Intentionally drops the notification.
+	case "email":
+		emailActor(name, cfg, doc)
+	case "exec":
+		execActor(name, cfg, doc)
+	default:
+		log.Printf("pipeline: actor %q has unknown type %q", name, cfg.Type)
+	}
+}
+
+func webhookActor(name string, cfg ActorConfig, doc map[string]interface{}) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("pipeline: actor %q failed to marshal notification: %v", name, err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.URL, "application/ld+json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("pipeline: actor %q webhook to %s failed: %v", name, cfg.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Printf("pipeline: actor %q webhook to %s returned %d", name, cfg.URL, resp.StatusCode)
+	}
+}
+
+func logActor(name string, doc map[string]interface{}) {
+	log.Printf("pipeline: actor %q received notification %s", name, stringField(doc, "id"))
+}
+
+// emailActor sends a minimal plaintext notice to cfg.To via the local MTA
+// on localhost:25. Operators that need auth or a relay should front this
+// with a webhook actor instead until SMTP configuration is exposed here.
+func emailActor(name string, cfg ActorConfig, doc map[string]interface{}) {
+	if cfg.To == "" {
+		log.Printf("pipeline: actor %q has no \"to\" address configured", name)
+		return
+	}
+
+	msg := fmt.Sprintf("Subject: new citation notification\r\n\r\n%s received a notification about %s\r\n",
+		stringField(doc, "actor"), stringField(doc, "target"))
+
+	if err := smtp.SendMail("localhost:25", nil, "citemicroservices@localhost", []string{cfg.To}, []byte(msg)); err != nil {
+		log.Printf("pipeline: actor %q failed to send email to %s: %v", name, cfg.To, err)
+	}
+}
+
+func execActor(name string, cfg ActorConfig, doc map[string]interface{}) {
+	if cfg.Executable == "" {
+		log.Printf("pipeline: actor %q has no executable configured", name)
+		return
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		log.Printf("pipeline: actor %q failed to marshal notification: %v", name, err)
+		return
+	}
+
+	cmd := exec.Command(cfg.Executable)
+	cmd.Stdin = bytes.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("pipeline: actor %q executable %s failed: %v (%s)", name, cfg.Executable, err, out)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idempotencyTTL bounds how long an Idempotency-Key is remembered. After
+// it expires a retried POST with the same key is treated as new, same as
+// if the key had never been seen.
+const idempotencyTTL = 24 * time.Hour
+
+func idempotencyStoreKey(inboxID, key string) string {
+	return fmt.Sprintf("idem-%s-%s", inboxID, key)
+}
+
+// lookupIdempotencyKeyTxn reports whether key was already used to create a
+// notification in inboxID, returning that notification's ID if so. It
+// takes txn rather than opening its own, so createNotification can check
+// this in the same transaction that files the notification: two
+// concurrent POSTs with the same key can then never both miss the check.
+func lookupIdempotencyKeyTxn(txn *badger.Txn, inboxID, key string) (string, bool, error) {
+	item, err := txn.Get([]byte(idempotencyStoreKey(inboxID, key)))
+	if err == badger.ErrKeyNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	var notificationID string
+	err = item.Value(func(v []byte) error {
+		notificationID = string(v)
+		return nil
+	})
+	return notificationID, true, err
+}
+
+// storeIdempotencyKeyTxn remembers that key created notificationID in
+// inboxID, so a retried POST with the same key can be answered without
+// creating a duplicate. Like lookupIdempotencyKeyTxn, it runs inside the
+// caller's transaction rather than its own.
+func storeIdempotencyKeyTxn(txn *badger.Txn, inboxID, key, notificationID string) error {
+	entry := badger.NewEntry([]byte(idempotencyStoreKey(inboxID, key)), []byte(notificationID)).WithTTL(idempotencyTTL)
+	return txn.SetEntry(entry)
+}
+
+// parseRequestOptions reads per-request delivery retry options off an
+// inbox POST, mirroring the Idempotency-Key pattern: callers that know
+// their downstream recipient better than our defaults can tighten the
+// attempt budget or narrow which statuses are worth retrying at all.
+func parseRequestOptions(r *http.Request) RequestOptions {
+	opts := defaultRequestOptions()
+
+	if v := r.Header.Get("Idempotency-Max-Attempts"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			opts.MaxAttempts = n
+		}
+	}
+
+	if v := r.Header.Get("Idempotency-Retry-On"); v != "" {
+		var codes []int
+		for _, part := range strings.Split(v, ",") {
+			if n, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+				codes = append(codes, n)
+			}
+		}
+		if len(codes) > 0 {
+			opts.RetryOn = codes
+		}
+	}
+
+	return opts
+}
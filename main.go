@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"github.com/dgraph-io/badger"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+)
+
+var db *badger.DB
+
+func main() {
+	dbPath := flag.String("db", "./data", "path to the Badger database directory")
+	addr := flag.String("addr", ":8080", "address to listen on")
+	baseURL := flag.String("base-url", "http://localhost:8080", "this node's externally-reachable origin")
+	keyPath := flag.String("key", "./keys/instance.pem", "path to this node's federation keypair")
+	configPath := flag.String("config", "./config.json", "path to the filter/actor pipeline config")
+	flag.Parse()
+
+	instanceBaseURL = *baseURL
+
+	var err error
+	instanceKey, err = loadOrGenerateKeypair(*keyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pipelineConfig, err = loadPipelineConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := badger.DefaultOptions(*dbPath)
+
+	db, err = badger.Open(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	startDeliveryWorker()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/actor", handleActor)
+	r.HandleFunc("/texts/{URN}/inbox/stream", handleInboxStream).Methods(http.MethodGet)
+	r.HandleFunc("/texts/{URN}/inbox", handleInbox)
+	r.HandleFunc("/texts/{URN}/inbox/{ID}", handleNotification)
+
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, r))
+}
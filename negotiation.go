@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content types this service is able to produce for an LDN resource, in the
+// order they should win a tie when the client's Accept header does not
+// distinguish between them.
+var supportedLDNTypes = []string{
+	"application/ld+json",
+	"text/turtle",
+	"application/n-triples",
+}
+
+// negotiateContentType picks the best representation for accept against
+// supportedLDNTypes, following RFC 7231 quality-value precedence. It returns
+// "" if none of the offered types are acceptable.
+func negotiateContentType(accept string) string {
+	if accept == "" {
+		return supportedLDNTypes[0]
+	}
+
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		segments := strings.Split(part, ";")
+		mediaType := strings.TrimSpace(segments[0])
+		q := 1.0
+		for _, param := range segments[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		candidates = append(candidates, candidate{mediaType, q})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	for _, c := range candidates {
+		if c.q <= 0 {
+			continue
+		}
+		if c.mediaType == "*/*" {
+			return supportedLDNTypes[0]
+		}
+		for _, offered := range supportedLDNTypes {
+			if c.mediaType == offered {
+				return offered
+			}
+			if strings.HasSuffix(c.mediaType, "/*") && strings.HasPrefix(offered, strings.TrimSuffix(c.mediaType, "*")) {
+				return offered
+			}
+		}
+	}
+
+	return ""
+}
+
+// setInboxLinkHeader advertises the discovery link an LDN target resource
+// must expose so senders can find where to deliver notifications about it,
+// per https://www.w3.org/TR/ldn/#discovery. Handlers for resources that
+// represent the target itself (e.g. the text/passage resource) should call
+// this in addition to the inbox handler advertising itself.
+func setInboxLinkHeader(w http.ResponseWriter, r *http.Request, inboxURN string) {
+	inboxURL := fmt.Sprintf("http://%s/texts/%s/inbox", r.Host, inboxURN)
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="http://www.w3.org/ns/ldp#inbox"`, inboxURL))
+}
+
+// handleInboxOptions answers an LDN OPTIONS preflight, advertising which
+// methods and POST payload types the inbox accepts.
+func handleInboxOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, HEAD, OPTIONS, POST")
+	w.Header().Set("Accept-Post", strings.Join(supportedLDNTypes, ", "))
+	w.WriteHeader(http.StatusOK)
+}
+
+// negotiateAndWrite picks a representation per the client's Accept header
+// and writes it, serializing ldjson directly for application/ld+json and
+// deferring to turtle/ntriples for the RDF representations. It 406s if
+// none of the supported types were acceptable.
+func negotiateAndWrite(w http.ResponseWriter, r *http.Request, ldjson interface{}, turtle, ntriples func() string) {
+	switch negotiateContentType(r.Header.Get("Accept")) {
+	case "text/turtle":
+		w.Header().Set("content-type", "text/turtle")
+		w.Write([]byte(turtle()))
+	case "application/n-triples":
+		w.Header().Set("content-type", "application/n-triples")
+		w.Write([]byte(ntriples()))
+	case "application/ld+json":
+		w.Header().Set("content-type", "application/ld+json")
+		writeJSON(w, ldjson)
+	default:
+		http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+	}
+}
+
+// notificationDocToTurtle renders the well-known Activity Streams 2.0
+// properties of a notification as Turtle. Arbitrary extra JSON-LD
+// properties a sender included are not expanded, since doing so correctly
+// requires a full JSON-LD processor; this covers the constrained vocabulary
+// handleInbox actually validates.
+func notificationDocToTurtle(doc map[string]interface{}) string {
+	var b strings.Builder
+	b.WriteString("@prefix as: <https://www.w3.org/ns/activitystreams#> .\n\n")
+	subject := stringField(doc, "@id")
+	fmt.Fprintf(&b, "<%s> a as:%s", subject, stringField(doc, "@type"))
+	writeTripleLineTurtle(&b, "as:actor", "<"+stringField(doc, "actor")+">")
+	writeTripleLineTurtle(&b, "as:object", "<"+stringField(doc, "object")+">")
+	writeTripleLineTurtle(&b, "as:target", "<"+stringField(doc, "target")+">")
+	if updated := stringField(doc, "updated"); updated != "" {
+		writeTripleLineTurtle(&b, "as:updated", fmt.Sprintf("%q", updated))
+	}
+	b.WriteString(" .\n")
+	return b.String()
+}
+
+func writeTripleLineTurtle(b *strings.Builder, predicate, object string) {
+	fmt.Fprintf(b, " ;\n    %s %s", predicate, object)
+}
+
+func notificationDocToNTriples(doc map[string]interface{}) string {
+	var b strings.Builder
+	subject := stringField(doc, "@id")
+	fmt.Fprintf(&b, "<%s> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <https://www.w3.org/ns/activitystreams#%s> .\n", subject, stringField(doc, "@type"))
+	fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#actor> <%s> .\n", subject, stringField(doc, "actor"))
+	fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#object> <%s> .\n", subject, stringField(doc, "object"))
+	fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#target> <%s> .\n", subject, stringField(doc, "target"))
+	if updated := stringField(doc, "updated"); updated != "" {
+		fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#updated> %q .\n", subject, updated)
+	}
+	return b.String()
+}
+
+func stringField(doc map[string]interface{}, key string) string {
+	if v, ok := doc[key].(string); ok {
+		return v
+	}
+	return ""
+}
@@ -6,66 +6,55 @@ import (
 	"github.com/dgraph-io/badger"
 	uuid "github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"io"
 	"net/http"
 )
 
 type Notification struct {
-	ID      string `json:"id"`
-	Actor   string `json:"actor"`
-	Object  string `json:"object"`
-	Target  string `json:"target"`
-	Updated string `json:"updated"`
+	ID      string          `json:"id"`
+	Seq     uint64          `json:"seq"`
+	Type    string          `json:"type"`
+	Actor   string          `json:"actor"`
+	Object  string          `json:"object"`
+	Target  string          `json:"target"`
+	Updated string          `json:"updated"`
+	Body    json.RawMessage `json:"body"`
 }
 
-type LDNInbox struct {
-	Context  string   `json:"@context"`
-	ID       string   `json:"@id"`
-	Contains []string `json:"contains"`
-}
-
-type LDNotification struct {
-	Context string `json:"@context"`
-	ID      string `json:"@id"`
-	Type    string `json:"@type"`
-	Actor   string `json:"actor"`
-	Object  string `json:"object"`
-	Target  string `json:"target"`
-	Updated string `json:"updated"`
-}
+// ldnRequiredFields are the properties the LDN constraint set
+// (https://www.w3.org/TR/ldn/#sender) requires on a notification body so
+// that it can be filed into an inbox.
+var ldnRequiredFields = []string{"@context", "@type", "actor", "object", "target"}
 
-const maxResponseSize = 128
+// validateLDNBody parses raw as a generic JSON-LD document and checks it
+// satisfies the LDN constraint set, rather than forcing it into the fixed
+// Notification shape. This lets third-party senders POST arbitrary
+// Activity Streams 2.0 notifications and have them preserved verbatim.
+func validateLDNBody(raw []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
 
-func getInbox(inboxID string) ([]Notification, error) {
-	notifications := make([]Notification, 0, maxResponseSize)
-	err := db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		prefix := []byte(fmt.Sprintf("%s-", inboxID))
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			err := item.Value(func(v []byte) error {
-				var notification Notification
-				err := json.Unmarshal(v, &notification)
-				if err != nil {
-					return err
-				}
-				notifications = append(notifications, notification)
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+	var missing []string
+	for _, field := range ldnRequiredFields {
+		if _, ok := doc[field]; !ok {
+			missing = append(missing, field)
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("not a valid LDN notification, missing fields: %v", missing)
+	}
+
+	return doc, nil
+}
 
-	return notifications, nil
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	json.NewEncoder(w).Encode(v)
 }
 
+const maxResponseSize = 128
+
 func getNotification(inboxID string, notificationID string) (Notification, error) {
 	var notification Notification
 	err := db.View(func(txn *badger.Txn) error {
@@ -84,31 +73,119 @@ func getNotification(inboxID string, notificationID string) (Notification, error
 		return nil
 	})
 	if err != nil {
-		return Notification{}, nil
+		return Notification{}, err
 	}
 
 	return notification, nil
 }
 
-func createNotification(inboxID string, notification Notification) (Notification, error) {
-	notification.ID = uuid.New().String()
+// createNotification stores doc, a validated LDN notification body, under
+// inboxID. The body is preserved verbatim (aside from the "id" this
+// service assigns it) rather than narrowed to a fixed set of fields, so
+// any extra Activity Streams 2.0 properties a sender included round-trip
+// back out on GET.
+//
+// If idempotencyKey is non-empty, the existing-notification check and the
+// write happen inside the same Badger transaction, so two concurrent
+// POSTs with the same key can't both miss the check and both persist; the
+// second caller gets back the first's notification with created=false.
+func createNotification(inboxID string, doc map[string]interface{}, idempotencyKey string) (notification Notification, created bool, err error) {
+	id := uuid.New().String()
+	doc["id"] = id
+
+	seq, err := nextSequence(inboxID)
+	if err != nil {
+		return Notification{}, false, err
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return Notification{}, false, err
+	}
+
+	notification = Notification{
+		ID:      id,
+		Seq:     seq,
+		Type:    stringField(doc, "@type"),
+		Actor:   stringField(doc, "actor"),
+		Object:  stringField(doc, "object"),
+		Target:  stringField(doc, "target"),
+		Updated: stringField(doc, "updated"),
+		Body:    body,
+	}
 
 	n, err := json.Marshal(&notification)
 	if err != nil {
-		return Notification{}, err
+		return Notification{}, false, err
 	}
 
+	var existing Notification
 	err = db.Update(func(txn *badger.Txn) error {
-		id := fmt.Sprintf("%s-%s", inboxID, notification.ID)
-		e := badger.NewEntry([]byte(id), n)
-		err := txn.SetEntry(e)
-		return err
+		if idempotencyKey != "" {
+			existingID, found, err := lookupIdempotencyKeyTxn(txn, inboxID, idempotencyKey)
+			if err != nil {
+				return err
+			}
+			if found {
+				item, err := txn.Get([]byte(fmt.Sprintf("%s-%s", inboxID, existingID)))
+				if err != nil {
+					return err
+				}
+				return item.Value(func(v []byte) error {
+					return json.Unmarshal(v, &existing)
+				})
+			}
+		}
+
+		key := fmt.Sprintf("%s-%s", inboxID, notification.ID)
+		if err := txn.SetEntry(badger.NewEntry([]byte(key), n)); err != nil {
+			return err
+		}
+		if err := txn.SetEntry(badger.NewEntry([]byte(streamKey(inboxID, seq)), n)); err != nil {
+			return err
+		}
+		if err := txn.SetEntry(badger.NewEntry([]byte(timeIndexKey(inboxID, notification.Updated, notification.ID)), n)); err != nil {
+			return err
+		}
+		if _, err := incrementCounterTxn(txn, counterKey(inboxID)); err != nil {
+			return err
+		}
+		if idempotencyKey != "" {
+			if err := storeIdempotencyKeyTxn(txn, inboxID, idempotencyKey, notification.ID); err != nil {
+				return err
+			}
+		}
+		created = true
+		return nil
 	})
 	if err != nil {
-		return Notification{}, err
+		return Notification{}, false, err
 	}
 
-	return Notification{}, nil
+	if !created {
+		return existing, false, nil
+	}
+
+	publishNotification(inboxID, notification)
+	go runPipeline(doc)
+
+	return notification, true, nil
+}
+
+// publishNotification fans a newly created notification out to any
+// clients subscribed to the inbox's SSE stream.
+func publishNotification(inboxID string, n Notification) {
+	doc, err := notificationDoc(n, func(id string) string {
+		return fmt.Sprintf("%s/texts/%s/inbox/%s", instanceBaseURL, inboxID, id)
+	})
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	bus.publish(inboxID, sseEvent{Seq: n.Seq, Data: data})
 }
 
 type stringTransform = func(string) string
@@ -121,24 +198,16 @@ func mapNotificationsID(ns []Notification, transform stringTransform) []string {
 	return ids
 }
 
-func makeLDNInbox(inboxID string, makeID stringTransform, ns []Notification) LDNInbox {
-	return LDNInbox{
-		Context:  "http://www.w3.org/ns/ldp",
-		ID:       inboxID,
-		Contains: mapNotificationsID(ns, makeID),
-	}
-}
-
-func makeLDNotification(makeID stringTransform, n Notification) LDNotification {
-	return LDNotification{
-		Context: "https://www.w3.org/ns/activitystreams",
-		ID:      makeID(n.ID),
-		Type:    "Announce",
-		Actor:   n.Actor,
-		Object:  n.Object,
-		Target:  n.Target,
-		Updated: n.Updated,
+// notificationDoc reconstructs the JSON-LD document a notification was
+// created from, resolving its "@id" to the fully-qualified IRI clients
+// dereference it at.
+func notificationDoc(n Notification, makeID stringTransform) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(n.Body, &doc); err != nil {
+		return nil, err
 	}
+	doc["@id"] = makeID(n.ID)
+	return doc, nil
 }
 
 func handleInbox(w http.ResponseWriter, r *http.Request) {
@@ -146,41 +215,53 @@ func handleInbox(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	inboxURN := vars["URN"]
 
-	if r.Method == http.MethodPost {
-		var n Notification
-
-		err := json.NewDecoder(r.Body).Decode(&n)
+	switch r.Method {
+	case http.MethodOptions:
+		handleInboxOptions(w, r)
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		notification, err := createNotification(inboxURN, n)
+		actor, err := verifyInboundSignature(r, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		doc, err := validateLDNBody(body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if stringField(doc, "actor") != actor {
+			http.Error(w, "federation: signing actor does not match notification actor", http.StatusForbidden)
+			return
+		}
 
-		w.Header().Set("content-type", "application/ld+json")
-		w.Header().Set("location", fmt.Sprintf("http://%s/texts/%s/inbox/%s", r.Host, inboxURN, notification.ID))
-		w.WriteHeader(201)
-	} else if r.Method == http.MethodGet {
-		// TODO: Get notifications
-		notifications, err := getInbox(inboxURN)
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		notification, created, err := createNotification(inboxURN, doc, idempotencyKey)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		inboxID := fmt.Sprintf("http://%s/texts/%s/inbox", r.Host, inboxURN)
-		inbox := makeLDNInbox(inboxID, func(id string) string {
-			return fmt.Sprintf("%s/%s", inboxID, id)
-		}, notifications)
+		if created {
+			if target := stringField(doc, "target"); isRemoteTarget(target, r.Host) {
+				enqueueDelivery(doc, target, parseRequestOptions(r))
+			}
+		}
+
 		w.Header().Set("content-type", "application/ld+json")
-		json.NewEncoder(w).Encode(inbox)
-	} else {
+		w.Header().Set("location", fmt.Sprintf("http://%s/texts/%s/inbox/%s", r.Host, inboxURN, notification.ID))
+		w.WriteHeader(201)
+	case http.MethodGet, http.MethodHead:
+		setInboxLinkHeader(w, r, inboxURN)
+		handleInboxCollection(w, r, inboxURN)
+	default:
 		http.Error(w, "Not Found", http.StatusNotFound)
-		return
 	}
 }
 
@@ -191,20 +272,42 @@ func handleNotification(w http.ResponseWriter, r *http.Request) {
 	inboxURN := vars["URN"]
 	notificationID := vars["ID"]
 
-	if r.Method != http.MethodGet {
-		w.WriteHeader(404)
-		w.Write([]byte("Not Found"))
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
 	}
 
 	notification, err := getNotification(inboxURN, notificationID)
+	if err == badger.ErrKeyNotFound {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	n := makeLDNotification(func(id string) string {
+	doc, err := notificationDoc(notification, func(id string) string {
 		return fmt.Sprintf("http://%s/texts/%s/inbox/%s", r.Host, inboxURN, id)
-	}, notification)
-	w.Header().Set("content-type", "application/ld+json")
-	json.NewEncoder(w).Encode(n)
+	})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	negotiateAndWrite(w, r,
+		doc,
+		func() string { return notificationDocToTurtle(doc) },
+		func() string { return notificationDocToNTriples(doc) },
+	)
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// OrderedCollection is the entry point into a notification inbox, per
+// https://www.w3.org/TR/activitystreams-core/#collections. It only carries
+// totalItems and paging links; the items themselves live on its pages.
+type OrderedCollection struct {
+	Context    interface{} `json:"@context"`
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	TotalItems uint64      `json:"totalItems"`
+	First      string      `json:"first"`
+	Last       string      `json:"last"`
+}
+
+// OrderedCollectionPage is one page of notifications within an
+// OrderedCollection, ordered oldest-first by "updated".
+type OrderedCollectionPage struct {
+	Context      interface{} `json:"@context"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	PartOf       string      `json:"partOf"`
+	Next         string      `json:"next,omitempty"`
+	Prev         string      `json:"prev,omitempty"`
+	OrderedItems []string    `json:"orderedItems"`
+}
+
+const asContext = "https://www.w3.org/ns/activitystreams"
+
+// pageOptions is the page/pageSize/since/until/type/actor query the client
+// asked the inbox collection to be filtered and sliced by.
+type pageOptions struct {
+	Page     int
+	PageSize int
+	Since    string
+	Until    string
+	Type     string
+	Actor    string
+}
+
+func parsePageOptions(q url.Values) (pageOptions, error) {
+	opts := pageOptions{
+		Page:     1,
+		PageSize: maxResponseSize,
+		Since:    q.Get("since"),
+		Until:    q.Get("until"),
+		Type:     q.Get("type"),
+		Actor:    q.Get("actor"),
+	}
+
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid page %q", v)
+		}
+		opts.Page = n
+	}
+
+	if v := q.Get("pageSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid pageSize %q", v)
+		}
+		if n > maxResponseSize {
+			n = maxResponseSize
+		}
+		opts.PageSize = n
+	}
+
+	return opts, nil
+}
+
+// counterKey and the time index below share the inboxID + updated + uuid
+// key scheme the request asked for, letting a time-range query seek
+// straight to "since" instead of scanning the whole inbox.
+func counterKey(inboxID string) string {
+	return fmt.Sprintf("total-%s", inboxID)
+}
+
+func timeIndexKey(inboxID, updated, id string) string {
+	return fmt.Sprintf("time-%s-%s-%s", inboxID, updated, id)
+}
+
+func readCounterTxn(txn *badger.Txn, key string) (uint64, error) {
+	item, err := txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var value uint64
+	err = item.Value(func(v []byte) error {
+		value = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	return value, err
+}
+
+// incrementCounterTxn bumps the totalItems counter for an inbox within the
+// same transaction that files the notification causing the bump, so the
+// count can never drift from what's actually stored.
+func incrementCounterTxn(txn *badger.Txn, key string) (uint64, error) {
+	value, err := readCounterTxn(txn, key)
+	if err != nil {
+		return 0, err
+	}
+	value++
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return value, txn.SetEntry(badger.NewEntry([]byte(key), buf))
+}
+
+func getTotalItems(inboxID string) (uint64, error) {
+	var total uint64
+	err := db.View(func(txn *badger.Txn) error {
+		v, err := readCounterTxn(txn, counterKey(inboxID))
+		total = v
+		return err
+	})
+	return total, err
+}
+
+// getInboxPage scans the inboxID+updated+uuid index for exactly the page
+// opts asks for: it seeks straight to "since" when given (or the start of
+// the index otherwise), skips past the (opts.Page-1)*opts.PageSize matches
+// that precede the requested page without materializing them, then stops
+// as soon as it has one more than PageSize matches past that offset — just
+// enough to know whether a "next" page exists. This keeps a ?page=N scan
+// bounded by the page window instead of the whole filtered result set.
+func getInboxPage(inboxID string, opts pageOptions) ([]Notification, bool, error) {
+	prefix := []byte(fmt.Sprintf("time-%s-", inboxID))
+	seekKey := prefix
+	if opts.Since != "" {
+		seekKey = []byte(fmt.Sprintf("time-%s-%s", inboxID, opts.Since))
+	}
+
+	offset := (opts.Page - 1) * opts.PageSize
+	var matches []Notification
+	hasMore := false
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		skipped := 0
+		for it.Seek(seekKey); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			var n Notification
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+
+			if opts.Until != "" && n.Updated > opts.Until {
+				break
+			}
+			if opts.Type != "" && n.Type != opts.Type {
+				continue
+			}
+			if opts.Actor != "" && n.Actor != opts.Actor {
+				continue
+			}
+
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			if len(matches) == opts.PageSize {
+				hasMore = true
+				break
+			}
+			matches = append(matches, n)
+		}
+		return nil
+	})
+	return matches, hasMore, err
+}
+
+// handleInboxCollection serves the LDP/AS2 paged view of an inbox: the
+// bare collection when no ?page was given, or a slice of matching
+// notifications as an OrderedCollectionPage when one was.
+func handleInboxCollection(w http.ResponseWriter, r *http.Request, inboxURN string) {
+	opts, err := parsePageOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inboxID := fmt.Sprintf("http://%s/texts/%s/inbox", r.Host, inboxURN)
+
+	if r.URL.Query().Get("page") == "" {
+		total, err := getTotalItems(inboxURN)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		writeCollection(w, r, makeOrderedCollection(inboxID, total, opts.PageSize))
+		return
+	}
+
+	matches, hasMore, err := getInboxPage(inboxURN, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeCollectionPage(w, r, makeOrderedCollectionPage(inboxID, opts, matches, hasMore, func(id string) string {
+		return fmt.Sprintf("%s/%s", inboxID, id)
+	}))
+}
+
+func makeOrderedCollection(inboxID string, total uint64, pageSize int) OrderedCollection {
+	lastPage := 1
+	if total > 0 {
+		lastPage = int((total + uint64(pageSize) - 1) / uint64(pageSize))
+	}
+
+	return OrderedCollection{
+		Context:    asContext,
+		ID:         inboxID,
+		Type:       "OrderedCollection",
+		TotalItems: total,
+		First:      fmt.Sprintf("%s?page=1&pageSize=%d", inboxID, pageSize),
+		Last:       fmt.Sprintf("%s?page=%d&pageSize=%d", inboxID, lastPage, pageSize),
+	}
+}
+
+// makeOrderedCollectionPage assumes matches is already exactly the window
+// getInboxPage scanned for opts.Page (no further slicing needed), and
+// hasMore reports whether that scan found a match past the window.
+func makeOrderedCollectionPage(inboxID string, opts pageOptions, matches []Notification, hasMore bool, makeID stringTransform) OrderedCollectionPage {
+	page := OrderedCollectionPage{
+		Context:      asContext,
+		ID:           pageURL(inboxID, opts, opts.Page),
+		Type:         "OrderedCollectionPage",
+		PartOf:       inboxID,
+		OrderedItems: mapNotificationsID(matches, makeID),
+	}
+
+	if opts.Page > 1 {
+		page.Prev = pageURL(inboxID, opts, opts.Page-1)
+	}
+	if hasMore {
+		page.Next = pageURL(inboxID, opts, opts.Page+1)
+	}
+	return page
+}
+
+func pageURL(inboxID string, opts pageOptions, page int) string {
+	q := url.Values{}
+	q.Set("page", strconv.Itoa(page))
+	q.Set("pageSize", strconv.Itoa(opts.PageSize))
+	if opts.Since != "" {
+		q.Set("since", opts.Since)
+	}
+	if opts.Until != "" {
+		q.Set("until", opts.Until)
+	}
+	if opts.Type != "" {
+		q.Set("type", opts.Type)
+	}
+	if opts.Actor != "" {
+		q.Set("actor", opts.Actor)
+	}
+	return fmt.Sprintf("%s?%s", inboxID, q.Encode())
+}
+
+func writeCollection(w http.ResponseWriter, r *http.Request, collection OrderedCollection) {
+	negotiateAndWrite(w, r,
+		collection,
+		func() string { return collectionToTurtle(collection) },
+		func() string { return collectionToNTriples(collection) },
+	)
+}
+
+func writeCollectionPage(w http.ResponseWriter, r *http.Request, page OrderedCollectionPage) {
+	negotiateAndWrite(w, r,
+		page,
+		func() string { return collectionPageToTurtle(page) },
+		func() string { return collectionPageToNTriples(page) },
+	)
+}
+
+func collectionToTurtle(c OrderedCollection) string {
+	var b strings.Builder
+	b.WriteString("@prefix as: <https://www.w3.org/ns/activitystreams#> .\n\n")
+	fmt.Fprintf(&b, "<%s> a as:OrderedCollection ;\n    as:totalItems %d ;\n    as:first <%s> ;\n    as:last <%s> .\n",
+		c.ID, c.TotalItems, c.First, c.Last)
+	return b.String()
+}
+
+func collectionToNTriples(c OrderedCollection) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <https://www.w3.org/ns/activitystreams#OrderedCollection> .\n", c.ID)
+	fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#totalItems> %q .\n", c.ID, fmt.Sprint(c.TotalItems))
+	fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#first> <%s> .\n", c.ID, c.First)
+	fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#last> <%s> .\n", c.ID, c.Last)
+	return b.String()
+}
+
+func collectionPageToTurtle(p OrderedCollectionPage) string {
+	var b strings.Builder
+	b.WriteString("@prefix as: <https://www.w3.org/ns/activitystreams#> .\n\n")
+	fmt.Fprintf(&b, "<%s> a as:OrderedCollectionPage ;\n    as:partOf <%s>", p.ID, p.PartOf)
+	for _, item := range p.OrderedItems {
+		fmt.Fprintf(&b, " ;\n    as:orderedItems <%s>", item)
+	}
+	b.WriteString(" .\n")
+	return b.String()
+}
+
+func collectionPageToNTriples(p OrderedCollectionPage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <https://www.w3.org/ns/activitystreams#OrderedCollectionPage> .\n", p.ID)
+	fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#partOf> <%s> .\n", p.ID, p.PartOf)
+	for _, item := range p.OrderedItems {
+		fmt.Fprintf(&b, "<%s> <https://www.w3.org/ns/activitystreams#orderedItems> <%s> .\n", p.ID, item)
+	}
+	return b.String()
+}
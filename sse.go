@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sseEvent is one notification pushed to inbox stream subscribers, keyed
+// by the per-inbox sequence number used as its SSE "id:" field.
+type sseEvent struct {
+	Seq  uint64
+	Data []byte
+}
+
+// eventBus fans out notifications created via createNotification to any
+// clients currently subscribed to that inbox's SSE stream.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[string]map[chan sseEvent]struct{}
+}
+
+var bus = &eventBus{subs: make(map[string]map[chan sseEvent]struct{})}
+
+func (b *eventBus) subscribe(inboxID string) chan sseEvent {
+	ch := make(chan sseEvent, 16)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[inboxID] == nil {
+		b.subs[inboxID] = make(map[chan sseEvent]struct{})
+	}
+	b.subs[inboxID][ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBus) unsubscribe(inboxID string, ch chan sseEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[inboxID], ch)
+	close(ch)
+}
+
+func (b *eventBus) publish(inboxID string, event sseEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[inboxID] {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber; drop rather than block notification creation.
+		}
+	}
+}
+
+// nextSequence hands out a monotonically increasing, durable sequence
+// number for inboxID, so SSE subscribers can resume with Last-Event-ID
+// after a reconnect.
+func nextSequence(inboxID string) (uint64, error) {
+	seq, err := db.GetSequence([]byte("seq-"+inboxID), 1)
+	if err != nil {
+		return 0, err
+	}
+	defer seq.Release()
+	return seq.Next()
+}
+
+func streamKey(inboxID string, seq uint64) string {
+	return fmt.Sprintf("stream-%s-%020d", inboxID, seq)
+}
+
+// currentMaxSeq returns the highest sequence number already committed to
+// inboxID's stream index, or 0 if the inbox has no notifications yet.
+// handleInboxStream reads this right after subscribing so it has a line
+// between what replayMissed will cover from the DB and what only arrives
+// on the live channel, so a notification filed around the moment a
+// client (re)connects isn't delivered twice.
+func currentMaxSeq(inboxID string) (uint64, error) {
+	prefix := []byte(fmt.Sprintf("stream-%s-", inboxID))
+	upperBound := []byte(fmt.Sprintf("stream-%s-%020d", inboxID, ^uint64(0)))
+
+	var maxSeq uint64
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Seek(upperBound)
+		if !it.ValidForPrefix(prefix) {
+			return nil
+		}
+
+		key := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+		seq, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return err
+		}
+		maxSeq = seq
+		return nil
+	})
+	return maxSeq, err
+}
+
+func writeSSEEvent(w http.ResponseWriter, event sseEvent) {
+	fmt.Fprintf(w, "id: %d\n", event.Seq)
+	fmt.Fprintf(w, "event: notification\n")
+	fmt.Fprintf(w, "data: %s\n\n", event.Data)
+}
+
+// handleInboxStream upgrades to an SSE connection and pushes each
+// notification createNotification files into inboxURN in real time. A
+// client reconnecting with Last-Event-ID first replays anything it missed
+// from the Badger-backed stream index before joining the live feed.
+func handleInboxStream(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	inboxURN := vars["URN"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := bus.subscribe(inboxURN)
+	defer bus.unsubscribe(inboxURN, ch)
+
+	// Snapshot the highest seq already in the DB right after subscribing,
+	// before replaying from it: replayMissed will cover everything up to
+	// this seq, so the live loop below skips anything at or below it
+	// instead of re-delivering it off the channel too.
+	snapshotSeq, err := currentMaxSeq(inboxURN)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		if err := replayMissed(w, inboxURN, lastID, snapshotSeq); err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if event.Seq <= snapshotSeq {
+				continue
+			}
+			writeSSEEvent(w, event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// replayMissed scans the stream index for inboxURN for seq in
+// (lastSeq, throughSeq], writing each as an SSE event in sequence order.
+// throughSeq is the snapshot handleInboxStream took right after
+// subscribing, so this never re-delivers something the live channel will
+// also carry.
+func replayMissed(w http.ResponseWriter, inboxURN string, lastID string, throughSeq uint64) error {
+	lastSeq, err := strconv.ParseUint(lastID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid Last-Event-ID: %w", err)
+	}
+
+	prefix := []byte(fmt.Sprintf("stream-%s-", inboxURN))
+	return db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			seq, err := strconv.ParseUint(strings.TrimPrefix(string(item.Key()), string(prefix)), 10, 64)
+			if err != nil {
+				return err
+			}
+			if seq > throughSeq {
+				break
+			}
+			if seq <= lastSeq {
+				continue
+			}
+
+			err = item.Value(func(v []byte) error {
+				var n Notification
+				if err := json.Unmarshal(v, &n); err != nil {
+					return err
+				}
+				doc, err := notificationDoc(n, func(id string) string {
+					return fmt.Sprintf("%s/texts/%s/inbox/%s", instanceBaseURL, inboxURN, id)
+				})
+				if err != nil {
+					return err
+				}
+				data, err := json.Marshal(doc)
+				if err != nil {
+					return err
+				}
+				writeSSEEvent(w, sseEvent{Seq: seq, Data: data})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}